@@ -46,25 +46,178 @@ func (s *ApiServer) AddFriends(ctx context.Context, in *api.AddFriendsRequest) (
 		}
 	}
 
-	if err := AddFriends(s.logger, s.db, userID, allIds); err != nil {
+	if err := AddFriends(s.logger, s.db, s.notificationRouter, s.friendCache, userID, allIds); err != nil {
+		if err == ErrFriendBlocked {
+			return nil, status.Error(codes.PermissionDenied, "Cannot add a user who has blocked you.")
+		}
 		return nil, status.Error(codes.Internal, "Error while trying to add friends.")
 	}
 
 	return &empty.Empty{}, nil
 }
 
+func (s *ApiServer) CancelFriendRequest(ctx context.Context, in *api.CancelFriendRequestRequest) (*empty.Empty, error) {
+	if in.GetId() == "" && in.GetUsername() == "" {
+		return nil, status.Error(codes.InvalidArgument, "Specify an ID or Username.")
+	}
+
+	friendID := in.GetId()
+	if friendID == "" {
+		userIDs, err := fetchUserID(s.db, []string{in.GetUsername()})
+		if err != nil || len(userIDs) == 0 {
+			return nil, status.Error(codes.InvalidArgument, "Username not found.")
+		}
+		friendID = userIDs[0]
+	}
+
+	userID := ctx.Value(ctxUserIDKey{}).(uuid.UUID)
+	if userID.String() == friendID {
+		return nil, status.Error(codes.InvalidArgument, "Cannot cancel a friend request to self.")
+	}
+
+	if err := CancelFriendRequest(s.logger, s.db, userID, friendID); err != nil {
+		return nil, status.Error(codes.Internal, "Error while trying to cancel friend request.")
+	}
+
+	return &empty.Empty{}, nil
+}
+
 func (s *ApiServer) BlockFriends(ctx context.Context, in *api.BlockFriendsRequest) (*empty.Empty, error) {
-	return nil, nil
+	if len(in.GetIds()) == 0 && len(in.GetUsernames()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Specify at least one ID or Username.")
+	}
+
+	userIDs, err := fetchUserID(s.db, in.GetUsernames())
+	if err != nil {
+		s.logger.Error("Could not fetch user IDs.", zap.Error(err), zap.Strings("usernames", in.GetUsernames()))
+		return nil, status.Error(codes.Internal, "Error while trying to block friends.")
+	}
+
+	allIds := make([]string, 0)
+	allIds = append(allIds, in.GetIds()...)
+	allIds = append(allIds, userIDs...)
+
+	userID := ctx.Value(ctxUserIDKey{}).(uuid.UUID)
+	for _, id := range allIds {
+		if userID.String() == id {
+			return nil, status.Error(codes.InvalidArgument, "Cannot block self.")
+		}
+	}
+
+	if err := BlockFriends(s.logger, s.db, s.notificationRouter, s.friendCache, userID, allIds); err != nil {
+		return nil, status.Error(codes.Internal, "Error while trying to block friends.")
+	}
+
+	return &empty.Empty{}, nil
 }
 
 func (s *ApiServer) DeleteFriends(ctx context.Context, in *api.DeleteFriendsRequest) (*empty.Empty, error) {
-	return nil, nil
+	if len(in.GetIds()) == 0 && len(in.GetUsernames()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Specify at least one ID or Username.")
+	}
+
+	userIDs, err := fetchUserID(s.db, in.GetUsernames())
+	if err != nil {
+		s.logger.Error("Could not fetch user IDs.", zap.Error(err), zap.Strings("usernames", in.GetUsernames()))
+		return nil, status.Error(codes.Internal, "Error while trying to delete friends.")
+	}
+
+	allIds := make([]string, 0)
+	allIds = append(allIds, in.GetIds()...)
+	allIds = append(allIds, userIDs...)
+
+	userID := ctx.Value(ctxUserIDKey{}).(uuid.UUID)
+	if err := DeleteFriends(s.logger, s.db, s.notificationRouter, s.friendCache, userID, allIds); err != nil {
+		return nil, status.Error(codes.Internal, "Error while trying to delete friends.")
+	}
+
+	return &empty.Empty{}, nil
 }
 
-func (s *ApiServer) ListFriends(ctx context.Context, in *empty.Empty) (*api.Friends, error) {
-	return nil, nil
+func (s *ApiServer) ListFriends(ctx context.Context, in *api.ListFriendsRequest) (*api.Friends, error) {
+	userID := ctx.Value(ctxUserIDKey{}).(uuid.UUID)
+
+	limit := 100
+	if in.GetLimit() != nil {
+		if in.GetLimit().Value < 1 || in.GetLimit().Value > 100 {
+			return nil, status.Error(codes.InvalidArgument, "Invalid limit - limit must be between 1 and 100.")
+		}
+		limit = int(in.GetLimit().Value)
+	}
+
+	var state *int32
+	if in.GetState() != nil {
+		if in.GetState().Value < 0 || in.GetState().Value > 4 {
+			return nil, status.Error(codes.InvalidArgument, "Invalid state - state must be between 0 and 4.")
+		}
+		stateValue := in.GetState().Value
+		state = &stateValue
+	}
+
+	var cursor *edgeListCursor
+	if in.GetCursor() != "" {
+		var err error
+		cursor, err = unmarshalEdgeListCursor(in.GetCursor())
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, "Malformed cursor was used.")
+		}
+	}
+
+	friends, nextCursor, err := GetFriends(s.logger, s.db, s.friendCache, userID, limit, state, cursor)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "Error while trying to list friends.")
+	}
+	friends.Cursor = nextCursor
+
+	return friends, nil
+}
+
+// ListBlocks is a gRPC-only endpoint for now - it needs a `google.api.http` annotation added
+// to ListBlocksRequest in api.proto (GET /v2/friend/block, mirroring ListFriends' GET
+// /v2/friend) before the REST gateway will expose it. That file isn't part of this change set,
+// so it's tracked here as a follow-up rather than left undocumented.
+func (s *ApiServer) ListBlocks(ctx context.Context, in *api.ListBlocksRequest) (*api.Friends, error) {
+	userID := ctx.Value(ctxUserIDKey{}).(uuid.UUID)
+
+	limit := 100
+	if in.GetLimit() != nil {
+		if in.GetLimit().Value < 1 || in.GetLimit().Value > 100 {
+			return nil, status.Error(codes.InvalidArgument, "Invalid limit - limit must be between 1 and 100.")
+		}
+		limit = int(in.GetLimit().Value)
+	}
+
+	var cursor *edgeListCursor
+	if in.GetCursor() != "" {
+		var err error
+		cursor, err = unmarshalEdgeListCursor(in.GetCursor())
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, "Malformed cursor was used.")
+		}
+	}
+
+	blockedState := int32(3)
+	blocks, nextCursor, err := GetFriends(s.logger, s.db, nil, userID, limit, &blockedState, cursor)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "Error while trying to list blocked users.")
+	}
+	blocks.Cursor = nextCursor
+
+	return blocks, nil
 }
 
 func (s *ApiServer) ImportFacebookFriends(ctx context.Context, in *api.ImportFacebookFriendsRequest) (*empty.Empty, error) {
-	return nil, nil
+	if in.GetAccount().GetToken() == "" {
+		return nil, status.Error(codes.InvalidArgument, "Facebook token is required.")
+	}
+
+	userID := ctx.Value(ctxUserIDKey{}).(uuid.UUID)
+	reset := in.GetReset_() != nil && in.GetReset_().Value
+
+	if err := ImportFriends(s.logger, s.db, s.friendCache, NewFacebookSocialGraphProvider(), userID, in.GetAccount().GetToken(), reset); err != nil {
+		s.logger.Error("Could not import Facebook friends.", zap.Error(err))
+		return nil, status.Error(codes.Internal, "Error while trying to import Facebook friends.")
+	}
+
+	return &empty.Empty{}, nil
 }
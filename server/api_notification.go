@@ -0,0 +1,52 @@
+// Copyright 2018 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"golang.org/x/net/context"
+
+	"github.com/heroiclabs/nakama/api"
+	"github.com/satori/go.uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func (s *ApiServer) ListNotifications(ctx context.Context, in *api.ListNotificationsRequest) (*api.NotificationList, error) {
+	userID := ctx.Value(ctxUserIDKey{}).(uuid.UUID)
+
+	limit := 100
+	if in.GetLimit() != nil {
+		if in.GetLimit().Value < 1 || in.GetLimit().Value > 100 {
+			return nil, status.Error(codes.InvalidArgument, "Invalid limit - limit must be between 1 and 100.")
+		}
+		limit = int(in.GetLimit().Value)
+	}
+
+	var cursor *notificationListCursor
+	if in.GetCacheableCursor() != "" {
+		var err error
+		cursor, err = unmarshalNotificationListCursor(in.GetCacheableCursor())
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, "Malformed cursor was used.")
+		}
+	}
+
+	notifications, err := GetNotifications(s.logger, s.db, userID, limit, cursor)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "Error while trying to list notifications.")
+	}
+
+	return notifications, nil
+}
@@ -15,8 +15,12 @@
 package server
 
 import (
+	"bytes"
 	"database/sql"
+	"encoding/base64"
+	"encoding/gob"
 	"errors"
+	"fmt"
 	"time"
 
 	"github.com/golang/protobuf/ptypes/timestamp"
@@ -25,23 +29,120 @@ import (
 	"go.uber.org/zap"
 )
 
-func GetFriends(logger *zap.Logger, db *sql.DB, userID uuid.UUID) (*api.Friends, error) {
+// Relationship states stored in user_edge.state. FriendStateWaiting is the passive side of
+// a relationship that was already formed as mutual by an external import (e.g. Facebook
+// friends who are mutually connected there already) - it lists alongside mutual friends but
+// doesn't carry the "invite accepted" notification an active FriendStateInviteReceived would.
+const (
+	FriendStateMutual         = 0
+	FriendStateInviteReceived = 1
+	FriendStateInviteSent     = 2
+	FriendStateBlocked        = 3
+	FriendStateWaiting        = 4
+)
+
+var (
+	// ErrFriendAlreadyExists is returned by addFriend when the requested relationship is
+	// already in place (mutual or a previously sent invite), when the call only lifted
+	// userID's own block on friendID, or when no new invite could be inserted - callers should
+	// treat repeat calls as a no-op rather than surfacing an error to the client. A waiting
+	// edge is promoted to mutual instead.
+	ErrFriendAlreadyExists = errors.New("friend relationship already exists")
+	// ErrFriendBlocked is returned by addFriend when the target has blocked the requester.
+	ErrFriendBlocked = errors.New("user has blocked this relationship")
+)
+
+// edgeListCursor is the keyset pagination cursor used by GetFriends. It points at the
+// last (position, destination_id) pair seen by the caller so the next page can resume
+// with a plain index range scan instead of an OFFSET.
+type edgeListCursor struct {
+	Position      int64
+	DestinationID string
+}
+
+func marshalEdgeListCursor(cursor *edgeListCursor) (string, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(cursor); err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+func unmarshalEdgeListCursor(cursorStr string) (*edgeListCursor, error) {
+	cb, err := base64.URLEncoding.DecodeString(cursorStr)
+	if err != nil {
+		return nil, err
+	}
+	cursor := &edgeListCursor{}
+	if err := gob.NewDecoder(bytes.NewReader(cb)).Decode(cursor); err != nil {
+		return nil, err
+	}
+	return cursor, nil
+}
+
+// GetFriends lists the edges for userID, newest first. When state is nil, blocked users
+// (state 3) are excluded so regular friend lists don't need client-side filtering; pass
+// a state to look up a single state instead, e.g. state=3 to list only blocked users.
+//
+// The unfiltered first page (state == nil, cursor == nil) is the hot path for login screens,
+// so it's the only shape cached - cache is consulted first and populated on miss. Pass a nil
+// cache to always hit the database, e.g. from ListBlocks which always filters by state.
+func GetFriends(logger *zap.Logger, db *sql.DB, cache FriendCache, userID uuid.UUID, limit int, state *int32, cursor *edgeListCursor) (*api.Friends, string, error) {
+	cacheable := cache != nil && state == nil && cursor == nil
+	if cacheable {
+		if friends, nextCursor, ok := cache.Get(userID); ok {
+			return friends, nextCursor, nil
+		}
+	}
+
+	params := []interface{}{userID}
 	query := `
 SELECT id, username, display_name, avatar_url,
 	lang_tag, location, timezone, metadata,
-	create_time, users.update_time, state
+	create_time, users.update_time, state, position
 FROM users, user_edge WHERE id = destination_id AND source_id = $1`
 
-	rows, err := db.Query(query, userID)
+	if state != nil {
+		params = append(params, *state)
+		query += fmt.Sprintf(" AND state = $%d", len(params))
+	} else {
+		query += " AND state != 3"
+	}
+
+	if cursor != nil {
+		params = append(params, cursor.Position, cursor.DestinationID)
+		query += fmt.Sprintf(" AND (position, id) < ($%d, $%d)", len(params)-1, len(params))
+	}
+
+	params = append(params, limit+1)
+	query += fmt.Sprintf(" ORDER BY position DESC, id DESC LIMIT $%d", len(params))
+
+	rows, err := db.Query(query, params...)
 	if err != nil {
 		logger.Error("Error retrieving friends.", zap.Error(err))
-		return nil, err
+		return nil, "", err
 	}
 	defer rows.Close()
 
-	friends := make([]*api.Friend, 0)
+	friends := make([]*api.Friend, 0, limit)
+	var lastPosition int64
+	var lastID string
 
 	for rows.Next() {
+		if len(friends) >= limit {
+			// There's at least one more row beyond the page we're returning, so a next page exists.
+			nextCursor, err := marshalEdgeListCursor(&edgeListCursor{Position: lastPosition, DestinationID: lastID})
+			if err != nil {
+				logger.Error("Error creating friends list cursor.", zap.Error(err))
+				return nil, "", err
+			}
+			result := &api.Friends{Friends: friends}
+			if cacheable {
+				cacheFriends(cache, userID, result, nextCursor)
+			}
+			return result, nextCursor, nil
+		}
+
 		var id string
 		var username sql.NullString
 		var displayName sql.NullString
@@ -53,10 +154,11 @@ FROM users, user_edge WHERE id = destination_id AND source_id = $1`
 		var createTime sql.NullInt64
 		var updateTime sql.NullInt64
 		var state sql.NullInt64
+		var position sql.NullInt64
 
-		if err = rows.Scan(&id, &username, &displayName, &avatarURL, &lang, &location, &timezone, &metadata, &createTime, &updateTime, &state); err != nil {
+		if err = rows.Scan(&id, &username, &displayName, &avatarURL, &lang, &location, &timezone, &metadata, &createTime, &updateTime, &state, &position); err != nil {
 			logger.Error("Error retrieving friends.", zap.Error(err))
-			return nil, err
+			return nil, "", err
 		}
 
 		user := &api.User{
@@ -77,24 +179,64 @@ FROM users, user_edge WHERE id = destination_id AND source_id = $1`
 			User:  user,
 			State: int32(state.Int64),
 		})
+		lastPosition, lastID = position.Int64, id
 	}
 	if err = rows.Err(); err != nil {
 		logger.Error("Error retrieving friends.", zap.Error(err))
-		return nil, err
+		return nil, "", err
 	}
 
-	return &api.Friends{Friends: friends}, nil
+	result := &api.Friends{Friends: friends}
+	if cacheable {
+		cacheFriends(cache, userID, result, "")
+	}
+	return result, "", nil
 }
 
-func AddFriends(logger *zap.Logger, db *sql.DB, currentUser uuid.UUID, ids []string) error {
+// cacheFriends stores the page just served by GetFriends. It relies entirely on
+// invalidateFriendCache being called wherever the underlying edges change - there's no
+// staleness check on read.
+func cacheFriends(cache FriendCache, userID uuid.UUID, friends *api.Friends, cursor string) {
+	cache.Set(userID, friends, cursor)
+}
+
+// invalidateFriendCache drops the cached friend list for currentUser and everyone whose
+// relationship with currentUser just changed, once their shared transaction has committed.
+func invalidateFriendCache(cache FriendCache, currentUser uuid.UUID, ids []string) {
+	if cache == nil {
+		return
+	}
+	cache.Invalidate(currentUser)
+	for _, id := range ids {
+		cache.Invalidate(uuid.FromStringOrNil(id))
+	}
+}
+
+func AddFriends(logger *zap.Logger, db *sql.DB, router NotificationRouter, cache FriendCache, currentUser uuid.UUID, ids []string) error {
 	ts := time.Now().UTC().Unix()
-	notificationToSend := make(map[string]bool)
+	notifications := make([]*NotificationSend, 0, len(ids))
 	if err := Transact(logger, db, func(tx *sql.Tx) error {
 		for _, id := range ids {
 			isFriendAccept, addFriendErr := addFriend(logger, tx, currentUser, id, ts)
 			if addFriendErr == nil {
-				notificationToSend[id] = isFriendAccept
-			} else if addFriendErr != sql.ErrNoRows { // Check to see if friend had blocked user.
+				code := NotificationFriendRequest
+				subject := "You've received a friend request."
+				if isFriendAccept {
+					code = NotificationFriendAccepted
+					subject = "Your friend request has been accepted."
+				}
+				notifications = append(notifications, &NotificationSend{
+					UserID:   uuid.FromStringOrNil(id),
+					SenderID: currentUser,
+					Code:     code,
+					Subject:  subject,
+					Content:  map[string]interface{}{"user_id": currentUser.String()},
+				})
+			} else if addFriendErr == ErrFriendAlreadyExists {
+				// Idempotent no-op: repeating an invite/accept after the relationship already
+				// exists shouldn't fail the whole batch or generate a duplicate notification.
+				continue
+			} else {
 				return addFriendErr
 			}
 		}
@@ -103,17 +245,14 @@ func AddFriends(logger *zap.Logger, db *sql.DB, currentUser uuid.UUID, ids []str
 		return err
 	}
 
-	// TODO(mo, zyro): Use notificationToSend to send notification here.
-	return nil
+	// The transaction committed, it's now safe to invalidate caches and push notifications.
+	invalidateFriendCache(cache, currentUser, ids)
+	return router.Send(logger, db, notifications)
 }
 
-// Returns "true" if accepting an invite, otherwise false
+// Returns "true" if accepting an invite, otherwise false. Returns ErrFriendAlreadyExists if
+// the relationship is already in place and ErrFriendBlocked if friendID has blocked userID.
 func addFriend(logger *zap.Logger, tx *sql.Tx, userID uuid.UUID, friendID string, timestamp int64) (bool, error) {
-	//TODO(mo, zyro, novabyte):
-	// - What's the right behaviour for adding someone that you had previously blocked?
-	// - How to unblock a friend? Delete friend or unblock api call?
-	// irrespective of above, we need to check for adding a friend that was previously blocked
-
 	// Unblock user if possible
 	res, err := tx.Exec("DELETE FROM user_edge WHERE source_id = $1 AND destination_id = $2 AND state = 3", userID, friendID)
 	if err != nil {
@@ -128,8 +267,30 @@ func addFriend(logger *zap.Logger, tx *sql.Tx, userID uuid.UUID, friendID string
 			return false, err
 		}
 
-		logger.Error("Unblocked user.", zap.String("user", userID.String()), zap.String("friend", friendID))
-		return false, sql.ErrNoRows
+		logger.Info("Unblocked user.", zap.String("user", userID.String()), zap.String("friend", friendID))
+		return false, ErrFriendAlreadyExists
+	}
+
+	// Promote a passive "waiting" edge left by an auto-import match (see addMutualFriend) to
+	// a full mutual friendship the first time userID takes an ordinary friending action
+	// against friendID.
+	var waitingState sql.NullInt64
+	err = tx.QueryRow("SELECT state FROM user_edge WHERE source_id = $1 AND destination_id = $2 AND state = $3",
+		userID, friendID, FriendStateWaiting).Scan(&waitingState)
+	if err != nil && err != sql.ErrNoRows {
+		logger.Error("Failed to check for a waiting friend edge.", zap.Error(err), zap.String("user", userID.String()), zap.String("friend", friendID))
+		return false, err
+	}
+	if waitingState.Valid {
+		if _, err := tx.Exec(`
+UPDATE user_edge SET state = $3, update_time = $4
+WHERE (source_id = $1 AND destination_id = $2) OR (source_id = $2 AND destination_id = $1)
+`, userID, friendID, FriendStateMutual, timestamp); err != nil {
+			logger.Error("Failed to promote waiting friend to mutual.", zap.Error(err), zap.String("user", userID.String()), zap.String("friend", friendID))
+			return false, err
+		}
+		logger.Info("Promoted waiting friend connection to mutual.", zap.String("user", userID.String()), zap.String("friend", friendID))
+		return true, nil
 	}
 
 	// Mark an invite as accepted, if one was in place.
@@ -149,7 +310,29 @@ OR (source_id = $2 AND destination_id = $1 AND state = 1)
 		return true, nil
 	}
 
-	// If no edge updates took place, it's either a new invite being set up, or user was blocked off by friend.
+	// Neither unblock nor accept applied - figure out why before trying to insert a new
+	// invite, so repeat calls and blocked-by-friend attempts get a typed result instead of
+	// a silent sql.ErrNoRows.
+	var ownState, friendState sql.NullInt64
+	err = tx.QueryRow(`
+SELECT
+  (SELECT state FROM user_edge WHERE source_id = $1 AND destination_id = $2),
+  (SELECT state FROM user_edge WHERE source_id = $2 AND destination_id = $1)
+`, userID, friendID).Scan(&ownState, &friendState)
+	if err != nil {
+		logger.Error("Failed to check existing user edge state.", zap.Error(err), zap.String("user", userID.String()), zap.String("friend", friendID))
+		return false, err
+	}
+
+	if friendState.Valid && friendState.Int64 == FriendStateBlocked {
+		return false, ErrFriendBlocked
+	}
+	if ownState.Valid {
+		logger.Info("Did not add new friend as friend connection already exists.", zap.String("user", userID.String()), zap.String("friend", friendID))
+		return false, ErrFriendAlreadyExists
+	}
+
+	// No edge exists yet either way, set up a new invite.
 	_, err = tx.Exec(`
 INSERT INTO user_edge (source_id, destination_id, state, position, update_time)
 SELECT source_id, destination_id, state, position, update_time
@@ -190,72 +373,153 @@ AND NOT EXISTS
 	// An invite was successfully added if both components were inserted.
 	if rowsAffected, _ := res.RowsAffected(); rowsAffected != 2 {
 		logger.Info("Did not add new friend as friend connection already exists or user is blocked.", zap.String("user", userID.String()), zap.String("friend", friendID))
-		return false, sql.ErrNoRows
+		return false, ErrFriendAlreadyExists
 	}
 
 	logger.Info("Added new friend invitation.", zap.String("user", userID.String()), zap.String("friend", friendID))
 	return false, nil
 }
 
-func DeleteFriends(logger *zap.Logger, db *sql.DB, currentUser uuid.UUID, ids []string) error {
+// CancelFriendRequest withdraws a friend invite the current user previously sent. Only edges
+// still in the pending invite states (2 on the sender's side, 1 on the recipient's) are
+// removed - a relationship that has since become mutual or was blocked is left untouched.
+func CancelFriendRequest(logger *zap.Logger, db *sql.DB, currentUser uuid.UUID, friendID string) error {
+	ts := time.Now().UTC().Unix()
+	return Transact(logger, db, func(tx *sql.Tx) error {
+		res, err := tx.Exec(`
+DELETE FROM user_edge
+WHERE (source_id = $1 AND destination_id = $2 AND state = $3)
+OR (source_id = $2 AND destination_id = $1 AND state = $4)`,
+			currentUser, friendID, FriendStateInviteSent, FriendStateInviteReceived)
+		if err != nil {
+			logger.Error("Failed to cancel friend request.", zap.Error(err), zap.String("user", currentUser.String()), zap.String("friend", friendID))
+			return err
+		}
+
+		rowsAffected, _ := res.RowsAffected()
+		if rowsAffected == 0 {
+			logger.Info("Could not cancel friend request as no pending invite was found.", zap.String("user", currentUser.String()), zap.String("friend", friendID))
+			return nil
+		}
+
+		if _, err = tx.Exec("UPDATE users SET edge_count = edge_count - 1, update_time = $3 WHERE id IN ($1, $2)", currentUser, friendID, ts); err != nil {
+			logger.Error("Failed to update user edge counts.", zap.Error(err), zap.String("user", currentUser.String()), zap.String("friend", friendID))
+			return err
+		}
+
+		return nil
+	})
+}
+
+func DeleteFriends(logger *zap.Logger, db *sql.DB, router NotificationRouter, cache FriendCache, currentUser uuid.UUID, ids []string) error {
 	ts := time.Now().UTC().Unix()
-	err := Transact(logger, db, func(tx *sql.Tx) error {
+	notifications := make([]*NotificationSend, 0, len(ids))
+	if err := Transact(logger, db, func(tx *sql.Tx) error {
 		for _, id := range ids {
-			if deleteFriendErr := deleteFriend(logger, tx, currentUser, id, ts); deleteFriendErr != nil {
+			deleted, deleteFriendErr := deleteFriend(logger, tx, currentUser, id, ts)
+			if deleteFriendErr != nil {
 				return deleteFriendErr
 			}
+			if deleted {
+				notifications = append(notifications, &NotificationSend{
+					UserID:   uuid.FromStringOrNil(id),
+					SenderID: currentUser,
+					Code:     NotificationFriendDeleted,
+					Subject:  "A friend has been removed.",
+					Content:  map[string]interface{}{"user_id": currentUser.String()},
+				})
+			}
 		}
 		return nil
-	})
+	}); err != nil {
+		return err
+	}
 
-	return err
+	invalidateFriendCache(cache, currentUser, ids)
+	return router.Send(logger, db, notifications)
 }
 
-func deleteFriend(logger *zap.Logger, tx *sql.Tx, userID uuid.UUID, friendID string, timestamp int64) error {
+// Returns true if a relationship existed and was deleted.
+func deleteFriend(logger *zap.Logger, tx *sql.Tx, userID uuid.UUID, friendID string, timestamp int64) (bool, error) {
 	res, err := tx.Exec("DELETE FROM user_edge WHERE (source_id = $1 AND destination_id = $2) OR (source_id = $2 AND destination_id = $1)", userID, friendID)
 	if err != nil {
 		logger.Error("Failed to delete user edge relationships.", zap.Error(err), zap.String("user", userID.String()), zap.String("friend", friendID))
-		return err
+		return false, err
 	}
 
 	rowsAffected, _ := res.RowsAffected()
 
 	if rowsAffected == 0 {
 		logger.Info("Could not delete user relationships as prior relationship did not exist.", zap.String("user", userID.String()), zap.String("friend", friendID))
-		return nil
+		return false, nil
 	} else if rowsAffected != 2 {
 		logger.Error("Unexpected number of edges were deleted.", zap.String("user", userID.String()), zap.String("friend", friendID), zap.Int64("rows_affected", rowsAffected))
-		return errors.New("unexpected number of edges were deleted")
+		return false, errors.New("unexpected number of edges were deleted")
 	}
 
 	if _, err = tx.Exec("UPDATE users SET edge_count = edge_count - 1, update_time = $3 WHERE id IN ($1, $2)", userID, friendID, timestamp); err != nil {
 		logger.Error("Failed to update user edge counts.", zap.Error(err), zap.String("user", userID.String()), zap.String("friend", friendID))
-		return err
+		return false, err
 	}
 
-	return nil
+	return true, nil
 }
 
-func BlockFriends(logger *zap.Logger, db *sql.DB, currentUser uuid.UUID, ids []string) error {
+// BlockFriends blocks each of ids on behalf of currentUser. The blocker gets a confirmation
+// notification for each user actually blocked; the blocked party is not told, unlike an
+// ordinary friend deletion, which notifies the removed friend.
+func BlockFriends(logger *zap.Logger, db *sql.DB, router NotificationRouter, cache FriendCache, currentUser uuid.UUID, ids []string) error {
 	ts := time.Now().UTC().Unix()
-	return Transact(logger, db, func(tx *sql.Tx) error {
+	notifications := make([]*NotificationSend, 0, len(ids))
+	if err := Transact(logger, db, func(tx *sql.Tx) error {
 		for _, id := range ids {
-			if blockFriendErr := blockFriend(logger, tx, currentUser, id, ts); blockFriendErr != nil {
+			blocked, blockFriendErr := blockFriend(logger, tx, currentUser, id, ts)
+			if blockFriendErr != nil {
 				return blockFriendErr
 			}
+			if !blocked {
+				continue
+			}
+			notifications = append(notifications, &NotificationSend{
+				UserID:   currentUser,
+				SenderID: currentUser,
+				Code:     NotificationFriendBlocked,
+				Subject:  "You've blocked a user.",
+				Content:  map[string]interface{}{"user_id": id},
+			})
 		}
 		return nil
-	})
+	}); err != nil {
+		return err
+	}
+
+	invalidateFriendCache(cache, currentUser, ids)
+	return router.Send(logger, db, notifications)
 }
 
-func blockFriend(logger *zap.Logger, tx *sql.Tx, userID uuid.UUID, friendID string, timestamp int64) error {
+// blockFriend blocks friendID on behalf of userID, returning whether a block edge was actually
+// created or updated - it's false when friendID doesn't exist, mirroring deleteFriend's signal
+// so BlockFriends knows not to raise a notification for a no-op.
+func blockFriend(logger *zap.Logger, tx *sql.Tx, userID uuid.UUID, friendID string, timestamp int64) (bool, error) {
+	// A repeat block of an already-blocked pair is a no-op, same as blocking a user who
+	// doesn't exist - bail out before touching anything so the caller doesn't raise a
+	// notification for a state that hasn't changed.
+	var existingState sql.NullInt64
+	if err := tx.QueryRow("SELECT state FROM user_edge WHERE source_id = $1 AND destination_id = $2", userID, friendID).Scan(&existingState); err != nil && err != sql.ErrNoRows {
+		logger.Error("Failed to check for an existing user edge.", zap.Error(err), zap.String("user", userID.String()), zap.String("friend", friendID))
+		return false, err
+	}
+	if existingState.Valid && existingState.Int64 == FriendStateBlocked {
+		return false, nil
+	}
+
 	// Try to update any previous edge between these users.
 	res, err := tx.Exec("UPDATE user_edge SET state = 3, update_time = $3 WHERE source_id = $1 AND destination_id = $2",
 		userID, friendID, timestamp)
 
 	if err != nil {
 		logger.Error("Failed to update user edge state.", zap.Error(err), zap.String("user", userID.String()), zap.String("friend", friendID))
-		return err
+		return false, err
 	}
 
 	if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
@@ -270,18 +534,18 @@ WHERE EXISTS (SELECT id FROM users WHERE id = $2::UUID)`
 		res, err = tx.Exec(query, userID, friendID, timestamp)
 		if err != nil {
 			logger.Error("Failed to block user.", zap.Error(err), zap.String("user", userID.String()), zap.String("friend", friendID))
-			return err
+			return false, err
 		}
 
 		if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
 			logger.Info("Could not block user as user may not exist.", zap.String("user", userID.String()), zap.String("friend", friendID))
-			return nil
+			return false, nil
 		}
 
 		// Update the edge count.
 		if _, err = tx.Exec("UPDATE users SET edge_count = edge_count + 1, update_time = $2 WHERE id = $1", userID, timestamp); err != nil {
 			logger.Error("Failed to update user edge count.", zap.Error(err), zap.String("user", userID.String()), zap.String("friend", friendID))
-			return err
+			return false, err
 		}
 	}
 
@@ -289,15 +553,15 @@ WHERE EXISTS (SELECT id FROM users WHERE id = $2::UUID)`
 	res, err = tx.Exec("DELETE FROM user_edge WHERE source_id = $1 AND destination_id = $2 AND state != 3", friendID, userID)
 	if err != nil {
 		logger.Error("Failed to update user edge state.", zap.Error(err), zap.String("user", userID.String()), zap.String("friend", friendID))
-		return err
+		return false, err
 	}
 
 	if rowsAffected, _ := res.RowsAffected(); rowsAffected == 1 {
 		if _, err = tx.Exec("UPDATE users SET edge_count = edge_count - 1, update_time = $2 WHERE id = $1", friendID, timestamp); err != nil {
 			logger.Error("Failed to update user edge count.", zap.Error(err), zap.String("user", userID.String()), zap.String("friend", friendID))
-			return err
+			return false, err
 		}
 	}
 
-	return nil
+	return true, nil
 }
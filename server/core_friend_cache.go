@@ -0,0 +1,172 @@
+// Copyright 2018 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/heroiclabs/nakama/api"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/satori/go.uuid"
+)
+
+var (
+	friendCacheHits = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "nakama",
+		Subsystem: "friend_cache",
+		Name:      "hits_total",
+		Help:      "Total number of friend list lookups served from cache.",
+	})
+	friendCacheMisses = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "nakama",
+		Subsystem: "friend_cache",
+		Name:      "misses_total",
+		Help:      "Total number of friend list lookups that missed the cache.",
+	})
+	friendCacheEvictions = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "nakama",
+		Subsystem: "friend_cache",
+		Name:      "evictions_total",
+		Help:      "Total number of friend list cache entries evicted, by size limit or TTL expiry.",
+	})
+)
+
+// FriendCache is consulted by GetFriends before it issues the full users/user_edge join, and
+// invalidated by AddFriends, DeleteFriends and BlockFriends once their transaction commits.
+// It's an interface so a Redis-backed implementation can stand in for multi-node deployments
+// without GetFriends needing to change.
+type FriendCache interface {
+	// Get returns the cached first page of friends for userID, if present and not expired.
+	Get(userID uuid.UUID) (friends *api.Friends, cursor string, ok bool)
+	// Set caches the first page of friends for userID. Callers are responsible for calling
+	// Invalidate once the underlying edges change - there is no staleness check on read.
+	Set(userID uuid.UUID, friends *api.Friends, cursor string)
+	// Invalidate drops any cached entry for userID.
+	Invalidate(userID uuid.UUID)
+}
+
+type friendCacheEntry struct {
+	key       string
+	payload   []byte
+	cursor    string
+	expiresAt time.Time
+}
+
+// LocalFriendCache is the default, single-node FriendCache: a bounded LRU keyed by user ID,
+// storing the serialized *api.Friends payload so entries can't be mutated through an aliased
+// pointer and so the same representation works if this is later swapped for a Redis cache.
+type LocalFriendCache struct {
+	sync.Mutex
+	maxEntries int
+	ttl        time.Duration
+	ll         *list.List
+	items      map[string]*list.Element
+}
+
+func NewLocalFriendCache(maxEntries int, ttl time.Duration) *LocalFriendCache {
+	return &LocalFriendCache{
+		maxEntries: maxEntries,
+		ttl:        ttl,
+		ll:         list.New(),
+		items:      make(map[string]*list.Element),
+	}
+}
+
+func (c *LocalFriendCache) Get(userID uuid.UUID) (*api.Friends, string, bool) {
+	key := userID.String()
+
+	c.Lock()
+	elem, ok := c.items[key]
+	if !ok {
+		c.Unlock()
+		friendCacheMisses.Inc()
+		return nil, "", false
+	}
+	entry := elem.Value.(*friendCacheEntry)
+	if time.Now().After(entry.expiresAt) {
+		c.removeElement(elem)
+		c.Unlock()
+		friendCacheEvictions.Inc()
+		friendCacheMisses.Inc()
+		return nil, "", false
+	}
+	c.ll.MoveToFront(elem)
+	c.Unlock()
+
+	friends := &api.Friends{}
+	if err := proto.Unmarshal(entry.payload, friends); err != nil {
+		// Corrupt entry, treat as a miss rather than returning bad data.
+		friendCacheMisses.Inc()
+		return nil, "", false
+	}
+
+	friendCacheHits.Inc()
+	return friends, entry.cursor, true
+}
+
+func (c *LocalFriendCache) Set(userID uuid.UUID, friends *api.Friends, cursor string) {
+	payload, err := proto.Marshal(friends)
+	if err != nil {
+		return
+	}
+
+	key := userID.String()
+	entry := &friendCacheEntry{
+		key:       key,
+		payload:   payload,
+		cursor:    cursor,
+		expiresAt: time.Now().Add(c.ttl),
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if elem, ok := c.items[key]; ok {
+		elem.Value = entry
+		c.ll.MoveToFront(elem)
+		return
+	}
+
+	c.items[key] = c.ll.PushFront(entry)
+	if c.maxEntries > 0 && c.ll.Len() > c.maxEntries {
+		oldest := c.ll.Back()
+		if oldest != nil {
+			c.removeElement(oldest)
+			friendCacheEvictions.Inc()
+		}
+	}
+}
+
+func (c *LocalFriendCache) Invalidate(userID uuid.UUID) {
+	key := userID.String()
+
+	c.Lock()
+	defer c.Unlock()
+
+	if elem, ok := c.items[key]; ok {
+		c.removeElement(elem)
+	}
+}
+
+// removeElement must be called with c.Mutex held.
+func (c *LocalFriendCache) removeElement(elem *list.Element) {
+	c.ll.Remove(elem)
+	entry := elem.Value.(*friendCacheEntry)
+	delete(c.items, entry.key)
+}
@@ -0,0 +1,82 @@
+// Copyright 2018 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/heroiclabs/nakama/api"
+	"github.com/satori/go.uuid"
+)
+
+func TestLocalFriendCacheGetSetInvalidate(t *testing.T) {
+	cache := NewLocalFriendCache(10, time.Minute)
+	userID := uuid.NewV4()
+
+	if _, _, ok := cache.Get(userID); ok {
+		t.Fatal("expected a miss before anything was cached")
+	}
+
+	friends := &api.Friends{Friends: []*api.Friend{{State: FriendStateMutual}}}
+	cache.Set(userID, friends, "cursor-1")
+
+	got, cursor, ok := cache.Get(userID)
+	if !ok {
+		t.Fatal("expected a hit after Set")
+	}
+	if cursor != "cursor-1" {
+		t.Fatalf("expected cursor %q, got %q", "cursor-1", cursor)
+	}
+	if len(got.Friends) != 1 || got.Friends[0].State != FriendStateMutual {
+		t.Fatalf("unexpected cached payload: %+v", got)
+	}
+
+	cache.Invalidate(userID)
+	if _, _, ok := cache.Get(userID); ok {
+		t.Fatal("expected a miss after Invalidate")
+	}
+}
+
+func TestLocalFriendCacheExpiry(t *testing.T) {
+	cache := NewLocalFriendCache(10, -time.Second)
+	userID := uuid.NewV4()
+
+	cache.Set(userID, &api.Friends{}, "")
+	if _, _, ok := cache.Get(userID); ok {
+		t.Fatal("expected an already-expired entry to be treated as a miss")
+	}
+}
+
+func TestLocalFriendCacheEvictsOldestBeyondMaxEntries(t *testing.T) {
+	cache := NewLocalFriendCache(2, time.Minute)
+	first := uuid.NewV4()
+	second := uuid.NewV4()
+	third := uuid.NewV4()
+
+	cache.Set(first, &api.Friends{}, "")
+	cache.Set(second, &api.Friends{}, "")
+	cache.Set(third, &api.Friends{}, "")
+
+	if _, _, ok := cache.Get(first); ok {
+		t.Fatal("expected the oldest entry to have been evicted")
+	}
+	if _, _, ok := cache.Get(second); !ok {
+		t.Fatal("expected the second entry to still be cached")
+	}
+	if _, _, ok := cache.Get(third); !ok {
+		t.Fatal("expected the third entry to still be cached")
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright 2018 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/satori/go.uuid"
+	"go.uber.org/zap"
+)
+
+// ImportFriends matches the external friend IDs reported by provider against existing Nakama
+// accounts and auto-connects any match as a friend, skipping the invite/accept round trip -
+// both sides already agreed to be friends on the external network. If reset is true, the
+// FriendStateWaiting edges between currentUser and users that have an ID on this provider
+// are deleted first; the FriendStateMutual edge on the other side of each such pair is not
+// removed, so friends from an earlier import stay on the importing user's own list.
+func ImportFriends(logger *zap.Logger, db *sql.DB, cache FriendCache, provider SocialGraphProvider, currentUser uuid.UUID, token string, reset bool) error {
+	externalIDs, err := provider.GetFriendIDs(token)
+	if err != nil {
+		logger.Error("Failed to fetch friends from social graph provider.", zap.Error(err), zap.String("provider", provider.Name()))
+		return err
+	}
+
+	ts := time.Now().UTC().Unix()
+	var matchedIDs []string
+	var resetIDs []string
+	if err := Transact(logger, db, func(tx *sql.Tx) error {
+		if reset {
+			// Only clears the passive (FriendStateWaiting) side of a prior import. The active
+			// side is written as an ordinary FriendStateMutual edge and is indistinguishable
+			// from a friendship the user formed by hand, so it's intentionally left alone here.
+			rows, err := tx.Query(fmt.Sprintf(`
+DELETE FROM user_edge WHERE state = $2 AND (
+  (source_id = $1 AND destination_id IN (SELECT id FROM users WHERE %s IS NOT NULL))
+  OR
+  (destination_id = $1 AND source_id IN (SELECT id FROM users WHERE %s IS NOT NULL))
+)
+RETURNING CASE WHEN source_id = $1 THEN destination_id ELSE source_id END`, provider.IDColumn(), provider.IDColumn()), currentUser, FriendStateWaiting)
+			if err != nil {
+				logger.Error("Failed to clear stale imported friends.", zap.Error(err), zap.String("provider", provider.Name()))
+				return err
+			}
+
+			for rows.Next() {
+				var id string
+				if err := rows.Scan(&id); err != nil {
+					rows.Close()
+					return err
+				}
+				resetIDs = append(resetIDs, id)
+			}
+			rowsErr := rows.Err()
+			rows.Close()
+			if rowsErr != nil {
+				return rowsErr
+			}
+		}
+
+		if len(externalIDs) == 0 {
+			return nil
+		}
+
+		rows, err := tx.Query(fmt.Sprintf("SELECT id FROM users WHERE %s = ANY($1)", provider.IDColumn()), pq.Array(externalIDs))
+		if err != nil {
+			logger.Error("Failed to match imported friends to existing users.", zap.Error(err), zap.String("provider", provider.Name()))
+			return err
+		}
+
+		matchedIDs = make([]string, 0, len(externalIDs))
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return err
+			}
+			matchedIDs = append(matchedIDs, id)
+		}
+		rowsErr := rows.Err()
+		rows.Close()
+		if rowsErr != nil {
+			return rowsErr
+		}
+
+		for _, friendID := range matchedIDs {
+			if friendID == currentUser.String() {
+				continue
+			}
+			if err := addMutualFriend(logger, tx, currentUser, friendID, ts); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	invalidateFriendCache(cache, currentUser, matchedIDs)
+	invalidateFriendCache(cache, currentUser, resetIDs)
+	return nil
+}
+
+// addMutualFriend connects userID and friendID directly as friends, bypassing the
+// invite/accept flow - used for auto-matched pairs from a social graph import, where both
+// sides already agreed to be friends on the external network. userID (the account running
+// the import) is marked FriendStateMutual immediately; friendID gets the passive
+// FriendStateWaiting side until they take their own ordinary friending action against userID,
+// at which point addFriend promotes it to mutual. Existing blocked or already-mutual edges
+// are left untouched.
+func addMutualFriend(logger *zap.Logger, tx *sql.Tx, userID uuid.UUID, friendID string, timestamp int64) error {
+	_, err := tx.Exec(`
+INSERT INTO user_edge (source_id, destination_id, state, position, update_time)
+SELECT source_id, destination_id, state, position, update_time
+FROM (VALUES
+  ($1::UUID, $2::UUID, $4::SMALLINT, $3::BIGINT, $3::BIGINT),
+  ($2::UUID, $1::UUID, $5::SMALLINT, $3::BIGINT, $3::BIGINT)
+) AS ue(source_id, destination_id, state, position, update_time)
+WHERE EXISTS (SELECT id FROM users WHERE id = $2::UUID)
+ON CONFLICT (source_id, destination_id) DO UPDATE SET state = EXCLUDED.state, update_time = EXCLUDED.update_time
+WHERE user_edge.state NOT IN (0, 3)
+`, userID, friendID, timestamp, FriendStateMutual, FriendStateWaiting)
+	if err != nil {
+		logger.Error("Failed to insert imported friend edge.", zap.Error(err), zap.String("user", userID.String()), zap.String("friend", friendID))
+		return err
+	}
+
+	// Only bump the edge count for edges that didn't already exist, using the same
+	// position-based "first time seen" check as addFriend.
+	if _, err = tx.Exec(`
+UPDATE users
+SET edge_count = edge_count + 1, update_time = $3
+WHERE
+	(id = $1::UUID OR id = $2::UUID)
+AND NOT EXISTS
+	(SELECT state
+   FROM user_edge
+   WHERE
+   	(source_id = $1 AND destination_id = $2 AND position <> $3)
+   	OR
+   	(source_id = $2 AND destination_id = $1 AND position <> $3)
+  )
+`, userID, friendID, timestamp); err != nil {
+		logger.Error("Failed to update user count.", zap.Error(err), zap.String("user", userID.String()), zap.String("friend", friendID))
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,116 @@
+// Copyright 2018 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// SocialGraphProvider fetches a user's friends from an external social network and tells the
+// importer which users column holds the matching external ID, so ImportFriends can stay the
+// same regardless of which network it's importing from.
+type SocialGraphProvider interface {
+	// Name identifies the provider in logs.
+	Name() string
+	// IDColumn is the users table column that stores this provider's external friend ID.
+	IDColumn() string
+	// GetFriendIDs returns the external friend IDs of the account that owns token.
+	GetFriendIDs(token string) ([]string, error)
+}
+
+const facebookGraphFriendsURL = "https://graph.facebook.com/v3.1/me/friends"
+
+// FacebookSocialGraphProvider validates the caller's Facebook token by listing their friends
+// straight from the Graph API.
+type FacebookSocialGraphProvider struct {
+	client *http.Client
+}
+
+func NewFacebookSocialGraphProvider() *FacebookSocialGraphProvider {
+	return &FacebookSocialGraphProvider{client: &http.Client{Timeout: 5 * time.Second}}
+}
+
+func (p *FacebookSocialGraphProvider) Name() string     { return "facebook" }
+func (p *FacebookSocialGraphProvider) IDColumn() string { return "facebook_id" }
+
+func (p *FacebookSocialGraphProvider) GetFriendIDs(token string) ([]string, error) {
+	var ids []string
+	next := facebookGraphFriendsURL + "?access_token=" + url.QueryEscape(token)
+
+	for next != "" {
+		resp, err := p.client.Get(next)
+		if err != nil {
+			return nil, err
+		}
+
+		var body struct {
+			Data []struct {
+				ID string `json:"id"`
+			} `json:"data"`
+			Paging struct {
+				Next string `json:"next"`
+			} `json:"paging"`
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("facebook graph api returned status %d", resp.StatusCode)
+		}
+		err = json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, friend := range body.Data {
+			ids = append(ids, friend.ID)
+		}
+		next = body.Paging.Next
+	}
+
+	return ids, nil
+}
+
+// GooglePlaySocialGraphProvider is a stub - Google Play Games friend import is not yet wired
+// up to an RPC, but the provider exists so ImportFriends already has somewhere to plug it in.
+type GooglePlaySocialGraphProvider struct{}
+
+func (p *GooglePlaySocialGraphProvider) Name() string     { return "google" }
+func (p *GooglePlaySocialGraphProvider) IDColumn() string { return "google_id" }
+func (p *GooglePlaySocialGraphProvider) GetFriendIDs(token string) ([]string, error) {
+	return nil, errors.New("google play games friend import is not yet implemented")
+}
+
+// SteamSocialGraphProvider is a stub, see GooglePlaySocialGraphProvider.
+type SteamSocialGraphProvider struct{}
+
+func (p *SteamSocialGraphProvider) Name() string     { return "steam" }
+func (p *SteamSocialGraphProvider) IDColumn() string { return "steam_id" }
+func (p *SteamSocialGraphProvider) GetFriendIDs(token string) ([]string, error) {
+	return nil, errors.New("steam friend import is not yet implemented")
+}
+
+// GameCenterSocialGraphProvider is a stub, see GooglePlaySocialGraphProvider.
+type GameCenterSocialGraphProvider struct{}
+
+func (p *GameCenterSocialGraphProvider) Name() string     { return "gamecenter" }
+func (p *GameCenterSocialGraphProvider) IDColumn() string { return "gamecenter_id" }
+func (p *GameCenterSocialGraphProvider) GetFriendIDs(token string) ([]string, error) {
+	return nil, errors.New("apple game center friend import is not yet implemented")
+}
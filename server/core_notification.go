@@ -0,0 +1,226 @@
+// Copyright 2018 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/heroiclabs/nakama/api"
+	"github.com/satori/go.uuid"
+	"go.uber.org/zap"
+)
+
+// NotificationCode identifies the kind of event a notification was raised for. Codes below
+// zero are reserved for Nakama-internal notifications, all others are available to games.
+type NotificationCode int32
+
+const (
+	NotificationFriendRequest NotificationCode = -(iota + 1)
+	NotificationFriendAccepted
+	NotificationFriendDeleted
+	NotificationFriendBlocked
+)
+
+// NotificationSend describes a single notification to be persisted and, if the recipient
+// is online, pushed immediately. It's the unit callers accumulate during a transaction and
+// hand off to a NotificationRouter once that transaction has committed.
+type NotificationSend struct {
+	UserID   uuid.UUID
+	SenderID uuid.UUID
+	Code     NotificationCode
+	Subject  string
+	Content  map[string]interface{}
+}
+
+// sessionNotifier is the narrow slice of the session registry that NotificationRouter needs
+// in order to push a notification to a user that's currently connected.
+type sessionNotifier interface {
+	NotificationSend(userID uuid.UUID, notifications []*api.Notification)
+}
+
+// NotificationRouter persists a batch of notifications and pushes them to any recipient that
+// is currently online. Callers must only invoke Send once the transaction that produced the
+// notifications has committed successfully, so an aborted transaction never results in a
+// phantom push.
+type NotificationRouter interface {
+	Send(logger *zap.Logger, db *sql.DB, notifications []*NotificationSend) error
+}
+
+// LocalNotificationRouter is the default NotificationRouter for a single-node deployment. It
+// writes notifications to the `notification` table and pushes to the in-process session
+// registry; a multi-node deployment would replace this with something that also fans the
+// push out over the cluster.
+type LocalNotificationRouter struct {
+	sessionRegistry sessionNotifier
+}
+
+func NewLocalNotificationRouter(sessionRegistry sessionNotifier) *LocalNotificationRouter {
+	return &LocalNotificationRouter{sessionRegistry: sessionRegistry}
+}
+
+func (r *LocalNotificationRouter) Send(logger *zap.Logger, db *sql.DB, notifications []*NotificationSend) error {
+	if len(notifications) == 0 {
+		return nil
+	}
+
+	ts := time.Now().UTC().Unix()
+	byUser := make(map[string][]*api.Notification, len(notifications))
+
+	err := Transact(logger, db, func(tx *sql.Tx) error {
+		for _, n := range notifications {
+			content, err := json.Marshal(n.Content)
+			if err != nil {
+				logger.Error("Failed to marshal notification content.", zap.Error(err))
+				return err
+			}
+
+			id := uuid.NewV4()
+			if _, err := tx.Exec(`
+INSERT INTO notification (id, user_id, subject, content, code, sender_id, create_time, persistent)
+VALUES ($1, $2, $3, $4, $5, $6, $7, true)`,
+				id, n.UserID, n.Subject, content, int32(n.Code), n.SenderID, ts); err != nil {
+				logger.Error("Failed to persist notification.", zap.Error(err), zap.String("user", n.UserID.String()))
+				return err
+			}
+
+			byUser[n.UserID.String()] = append(byUser[n.UserID.String()], &api.Notification{
+				Id:         id.String(),
+				Subject:    n.Subject,
+				Content:    string(content),
+				Code:       int32(n.Code),
+				SenderId:   n.SenderID.String(),
+				CreateTime: &timestamp.Timestamp{Seconds: ts},
+				Persistent: true,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if r.sessionRegistry == nil {
+		return nil
+	}
+	for userIDStr, userNotifications := range byUser {
+		userID := uuid.FromStringOrNil(userIDStr)
+		r.sessionRegistry.NotificationSend(userID, userNotifications)
+	}
+	return nil
+}
+
+// notificationListCursor is the keyset pagination cursor for ListNotifications, ordered
+// newest-first the same way GetFriends orders its edges.
+type notificationListCursor struct {
+	CreateTime     int64
+	NotificationID string
+}
+
+func marshalNotificationListCursor(cursor *notificationListCursor) (string, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(cursor); err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+func unmarshalNotificationListCursor(cursorStr string) (*notificationListCursor, error) {
+	cb, err := base64.URLEncoding.DecodeString(cursorStr)
+	if err != nil {
+		return nil, err
+	}
+	cursor := &notificationListCursor{}
+	if err := gob.NewDecoder(bytes.NewReader(cb)).Decode(cursor); err != nil {
+		return nil, err
+	}
+	return cursor, nil
+}
+
+// GetNotifications lists every persisted notification for userID, newest first, whether or not
+// it was also pushed, so a client can call this once on connect to catch up on what it missed
+// while offline before relying on the push path.
+func GetNotifications(logger *zap.Logger, db *sql.DB, userID uuid.UUID, limit int, cursor *notificationListCursor) (*api.NotificationList, error) {
+	params := []interface{}{userID}
+	query := `
+SELECT id, subject, content, code, sender_id, create_time, persistent
+FROM notification WHERE user_id = $1`
+
+	if cursor != nil {
+		params = append(params, cursor.CreateTime, cursor.NotificationID)
+		query += " AND (create_time, id) < ($2, $3)"
+	}
+
+	params = append(params, limit+1)
+	query += fmt.Sprintf(" ORDER BY create_time DESC, id DESC LIMIT $%d", len(params))
+
+	rows, err := db.Query(query, params...)
+	if err != nil {
+		logger.Error("Error retrieving notifications.", zap.Error(err))
+		return nil, err
+	}
+	defer rows.Close()
+
+	notifications := make([]*api.Notification, 0, limit)
+	var lastCreateTime int64
+	var lastID string
+
+	for rows.Next() {
+		if len(notifications) >= limit {
+			nextCursor, err := marshalNotificationListCursor(&notificationListCursor{CreateTime: lastCreateTime, NotificationID: lastID})
+			if err != nil {
+				logger.Error("Error creating notification list cursor.", zap.Error(err))
+				return nil, err
+			}
+			return &api.NotificationList{Notifications: notifications, CacheableCursor: nextCursor}, nil
+		}
+
+		var id string
+		var subject string
+		var content []byte
+		var code int32
+		var senderID string
+		var createTime int64
+		var persistent bool
+
+		if err := rows.Scan(&id, &subject, &content, &code, &senderID, &createTime, &persistent); err != nil {
+			logger.Error("Error retrieving notifications.", zap.Error(err))
+			return nil, err
+		}
+
+		notifications = append(notifications, &api.Notification{
+			Id:         id,
+			Subject:    subject,
+			Content:    string(content),
+			Code:       code,
+			SenderId:   senderID,
+			CreateTime: &timestamp.Timestamp{Seconds: createTime},
+			Persistent: persistent,
+		})
+		lastCreateTime, lastID = createTime, id
+	}
+	if err := rows.Err(); err != nil {
+		logger.Error("Error retrieving notifications.", zap.Error(err))
+		return nil, err
+	}
+
+	return &api.NotificationList{Notifications: notifications}, nil
+}